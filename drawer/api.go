@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"image"
 	"image/color"
@@ -32,10 +33,16 @@ const (
 
 var board [WIDTH * HEIGHT]int
 
+// boardLock guards board against concurrent writes from the periodic HTTP
+// snapshot and, when WS sync is active, the delta-reading goroutine.
+var boardLock sync.RWMutex
+
 func init() {
 }
 
 func getPixel(x int, y int) int {
+	boardLock.RLock()
+	defer boardLock.RUnlock()
 	return board[x*HEIGHT+y]
 }
 
@@ -66,8 +73,8 @@ func pixelToHex(rgb int) string {
 	return string(bs)
 }
 
-func getBoard() {
-	resp, err := http.Get(boardUrl)
+func (api *Api) getBoard() {
+	resp, err := api.get(boardUrl)
 	if err != nil {
 		fmt.Println("Could not get board!")
 		return
@@ -95,6 +102,7 @@ func getBoard() {
 		}
 
 		f.Write(buffer)
+		boardLock.Lock()
 		for j := 0; j < HEIGHT; j++ {
 			rgb := 0
 			for k := 0; k < 6; k++ {
@@ -102,6 +110,7 @@ func getBoard() {
 			}
 			board[i*HEIGHT+j] = rgb
 		}
+		boardLock.Unlock()
 		if i%10 == 0 {
 			fmt.Println("Line ", i, "done")
 		}
@@ -111,6 +120,9 @@ func getBoard() {
 func saveBoard(fp io.Writer) error {
 	img := image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
 
+	boardLock.RLock()
+	defer boardLock.RUnlock()
+
 	for i := 0; i < WIDTH; i++ {
 		for j := 0; j < HEIGHT; j++ {
 			pix := board[i*HEIGHT+j]
@@ -126,85 +138,177 @@ func saveBoard(fp io.Writer) error {
 	return png.Encode(fp, img)
 }
 
-type TokenResp struct {
-	status int    `json:"status"`
-	data   string `json:"data"`
+// Response is the JSON envelope every paintboard endpoint replies with:
+// {"status": <code>, "data": "<token or message>"}.
+type Response struct {
+	Status int    `json:"status"`
+	Data   string `json:"data"`
+}
+
+// ErrCode classifies the known non-200 `status` values the server sends
+// back, so callers can branch on the failure instead of grepping strings.
+type ErrCode int
+
+const (
+	ErrUnknown ErrCode = iota
+	ErrInvalidToken
+	ErrCooldown
+	ErrOutOfRange
+	ErrBanned
+)
+
+// ApiError wraps a non-success Response with a typed code.
+type ApiError struct {
+	Code   ErrCode
+	Status int
+	Data   string
+}
+
+func (err *ApiError) Error() string {
+	return fmt.Sprintf("paintboard: status %d: %s", err.Status, err.Data)
 }
 
-func ParseResp(bs []byte) (token TokenResp) {
-	var tmp map[string]interface{}
-	err := json.Unmarshal(bs, &tmp)
+func errCodeForStatus(status int) ErrCode {
+	switch status {
+	case 401:
+		return ErrInvalidToken
+	case 429:
+		return ErrCooldown
+	case 400:
+		return ErrOutOfRange
+	case 403:
+		return ErrBanned
+	default:
+		return ErrUnknown
+	}
+}
 
+func ParseResp(bs []byte) (Response, error) {
+	var resp Response
+	err := json.Unmarshal(bs, &resp)
 	if err != nil {
-		fmt.Println("Error: %v", err)
-		return
+		return resp, err
+	}
+	return resp, nil
+}
+
+// HTTPClient is the subset of *http.Client that Api depends on, so tests
+// can stub the paintboard endpoints without hitting the network.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func (api *Api) postForm(target string, body url.Values) ([]byte, error) {
+	req, err := http.NewRequest("POST", target, strings.NewReader(body.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	token.status, _ = tmp["status"].(int)
-	token.data, _ = tmp["data"].(string)
-	return
+	return ioutil.ReadAll(resp.Body)
 }
 
-// Token like dfe4d610-70c0-4fe6-b196-9b0e09ac920b
-func getToken(uid int, paste string) (bool, string) {
-	// s := fmt.Sprintf("uid=%v&paste=%v", uid, paste)
-	// body := strings.NewReader(s)
-	// resp, err := http.Post(tokenUrl, "x-www-form-urlencoded", body)
+func (api *Api) get(target string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.client.Do(req)
+}
 
+// Token like dfe4d610-70c0-4fe6-b196-9b0e09ac920b
+func (api *Api) getToken(uid int, paste string) (bool, string) {
 	body := url.Values{"uid": {strconv.Itoa(uid)}, "paste": {paste}}
-	resp, err := http.PostForm(tokenUrl, body)
+	bs, err := api.postForm(tokenUrl, body)
 
 	if err != nil {
 		fmt.Println("Could not get Token")
 		return false, err.Error()
 	}
-
-	bs, _ := ioutil.ReadAll(resp.Body)
 	fmt.Println(string(bs))
 
-	tok := ParseResp(bs)
-	tok.status = resp.StatusCode
-	if !strings.Contains(string(bs), "200") {
-		return false, tok.data
+	resp, err := ParseResp(bs)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false, err.Error()
+	}
+
+	if resp.Status != 200 {
+		apiErr := &ApiError{Code: errCodeForStatus(resp.Status), Status: resp.Status, Data: resp.Data}
+		fmt.Println("UKE:", apiErr)
+		return false, resp.Data
 	}
 	fmt.Println("Get ok!")
-	return true, tok.data
+	return true, resp.Data
 }
 
-func setPixel(x, y, c, uid int, token string) bool {
+func (api *Api) setPixel(x, y, c, uid int, token string) error {
 	body := url.Values{"x": {strconv.Itoa(x)}, "y": {strconv.Itoa(y)}, "color": {pixelToHex(c)}, "uid": {strconv.Itoa(uid)}, "token": {token}}
 	fmt.Println("Set", body)
-	resp, err := http.PostForm(paintUrl, body)
+	bs, err := api.postForm(paintUrl, body)
 
 	if err != nil {
 		fmt.Println("Counld not set Pixel:", err)
-		return false
+		return err
 	}
-
-	bs, _ := ioutil.ReadAll(resp.Body)
 	fmt.Println(string(bs))
 
-	tok := ParseResp(bs)
-	if !strings.Contains(string(bs), "200") {
-		fmt.Printf("UKE: %v\n", tok.data)
-		return false
+	resp, err := ParseResp(bs)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return err
+	}
+
+	if resp.Status != 200 {
+		apiErr := &ApiError{Code: errCodeForStatus(resp.Status), Status: resp.Status, Data: resp.Data}
+		fmt.Println("UKE:", apiErr)
+		return apiErr
 	}
 	fmt.Println("Ok at", x, y, pixelToHex(c))
-	return true
+	return nil
 }
 
 type Api struct {
-	cache map[int]string
-	lock  *sync.RWMutex
+	cache   map[int]string
+	lock    *sync.RWMutex
+	client  HTTPClient
+	onDelta func(x, y, c int)
+	store   StateStore
+}
+
+// SetStore attaches a StateStore so tokens (and, via ImageDrawer,
+// cooldowns and the uncert bitmap) survive a restart.
+func (api *Api) SetStore(store StateStore) {
+	api.store = store
 }
 
 func NewApi() *Api {
-	return &Api{make(map[int]string), new(sync.RWMutex)}
+	return &Api{make(map[int]string), new(sync.RWMutex), http.DefaultClient, nil, nil}
+}
+
+// NewApiWithClient builds an Api backed by a caller-supplied HTTPClient,
+// so tests can stub the paintboard endpoints without hitting the network.
+func NewApiWithClient(client HTTPClient) *Api {
+	return &Api{make(map[int]string), new(sync.RWMutex), client, nil, nil}
+}
+
+// SetDeltaHook registers fn to be called with every pixel change observed
+// by an active WebSocket BoardSource, in addition to it being applied to
+// board[]. Used by ImageDrawer to react to griefing the moment it happens
+// instead of waiting for the next full-board diff.
+func (api *Api) SetDeltaHook(fn func(x, y, c int)) {
+	api.onDelta = fn
 }
 
 func (api *Api) Update() {
 	fmt.Println("Updating...")
-	getBoard()
+	api.getBoard()
 	fmt.Println("Update Done !")
 }
 
@@ -226,19 +330,39 @@ func (api *Api) getCache(uid int) (string, bool) {
 func (api *Api) setCache(uid int, tok string) {
 	api.lock.Lock()
 	api.cache[uid] = tok
+	tokensActive.Set(float64(len(api.cache)))
 	api.lock.Unlock()
 }
 
 func (api *Api) ClearTokens() {
 	api.lock.Lock()
 	api.cache = make(map[int]string)
+	tokensActive.Set(0)
 	api.lock.Unlock()
 
 	api.SaveToken()
 }
 
+// SaveToken persists the token cache to the configured StateStore, or
+// falls back to the legacy `_api.txt` flat file when no store is set.
+// With a store, each cached token is added or overwritten; tokens the
+// store holds for uids no longer in the cache are not removed.
 func (api *Api) SaveToken() {
-	f, err := os.OpenFile("_api.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if api.store != nil {
+		api.lock.RLock()
+		defer api.lock.RUnlock()
+
+		for uid, tok := range api.cache {
+			if err := api.store.SaveToken(uid, tok, time.Now()); err != nil {
+				fmt.Println("Could not persist token:", err)
+			}
+		}
+		return
+	}
+
+	// O_TRUNC matters here: without it a shrinking cache leaves stale
+	// trailing lines that ReadToken would load back as ghost tokens.
+	f, err := os.OpenFile("_api.txt", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -256,6 +380,19 @@ func (api *Api) SaveToken() {
 }
 
 func (api *Api) ReadToken() {
+	if api.store != nil {
+		tokens, err := api.store.Tokens()
+		if err != nil {
+			fmt.Println("Could not load tokens:", err)
+			return
+		}
+		for uid, rec := range tokens {
+			api.setCache(uid, rec.Token)
+			fmt.Println("Cache ", uid, rec.Token)
+		}
+		return
+	}
+
 	f, err := os.Open("_api.txt")
 	if err != nil {
 		fmt.Println(err)
@@ -280,7 +417,7 @@ func (api *Api) GetToken(uid int, paste string) (bool, string) {
 		return ok, tok
 	}
 
-	ok, tok = getToken(uid, paste)
+	ok, tok = api.getToken(uid, paste)
 	if ok {
 		api.setCache(uid, tok)
 		api.SaveToken()
@@ -294,7 +431,7 @@ func (api *Api) GetTokenOrEmpty(uid int, paste string) string {
 		return tok
 	}
 
-	ok, tok = getToken(uid, paste)
+	ok, tok = api.getToken(uid, paste)
 	if ok {
 		api.setCache(uid, tok)
 		api.SaveToken()
@@ -303,6 +440,6 @@ func (api *Api) GetTokenOrEmpty(uid int, paste string) string {
 	return ""
 }
 
-func (api *Api) SetPixel(x, y, c, uid int, token string) bool {
-	return setPixel(x, y, c, uid, token)
+func (api *Api) SetPixel(x, y, c, uid int, token string) error {
+	return api.setPixel(x, y, c, uid, token)
 }
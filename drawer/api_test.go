@@ -0,0 +1,122 @@
+package drawer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// fakeHTTPClient stubs HTTPClient with a canned response (or error) so
+// tests never hit the network.
+type fakeHTTPClient struct {
+	status int
+	body   string
+	err    error
+}
+
+func (c *fakeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		StatusCode: c.status,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(c.body)),
+	}, nil
+}
+
+func TestParseResp(t *testing.T) {
+	resp, err := ParseResp([]byte(`{"status":200,"data":"ok"}`))
+	if err != nil {
+		t.Fatalf("ParseResp returned error: %v", err)
+	}
+	if resp.Status != 200 || resp.Data != "ok" {
+		t.Errorf("got %+v, want {200 ok}", resp)
+	}
+
+	if _, err := ParseResp([]byte(`not json`)); err == nil {
+		t.Error("expected an error for malformed JSON, got nil")
+	}
+}
+
+func TestErrCodeForStatus(t *testing.T) {
+	cases := map[int]ErrCode{
+		401: ErrInvalidToken,
+		429: ErrCooldown,
+		400: ErrOutOfRange,
+		403: ErrBanned,
+		500: ErrUnknown,
+	}
+	for status, want := range cases {
+		if got := errCodeForStatus(status); got != want {
+			t.Errorf("errCodeForStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestApiGetToken(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    string
+		wantOk  bool
+		wantTok string
+	}{
+		{"ok", `{"status":200,"data":"dfe4d610-70c0-4fe6-b196-9b0e09ac920b"}`, true, "dfe4d610-70c0-4fe6-b196-9b0e09ac920b"},
+		{"invalid token", `{"status":401,"data":"invalid"}`, false, "invalid"},
+		{"banned", `{"status":403,"data":"banned"}`, false, "banned"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := NewApiWithClient(&fakeHTTPClient{status: 200, body: tc.body})
+			ok, tok := api.getToken(1, "paste")
+			if ok != tc.wantOk || tok != tc.wantTok {
+				t.Errorf("getToken() = (%v, %q), want (%v, %q)", ok, tok, tc.wantOk, tc.wantTok)
+			}
+		})
+	}
+}
+
+func TestApiSetPixel(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    string
+		wantErr bool
+		code    ErrCode
+	}{
+		{"ok", `{"status":200,"data":"ok"}`, false, ErrUnknown},
+		{"cooldown", `{"status":429,"data":"cooldown"}`, true, ErrCooldown},
+		{"out of range", `{"status":400,"data":"out of range"}`, true, ErrOutOfRange},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := NewApiWithClient(&fakeHTTPClient{status: 200, body: tc.body})
+			err := api.setPixel(0, 0, 0xFFFFFF, 1, "token")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("setPixel() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				apiErr, ok := err.(*ApiError)
+				if !ok {
+					t.Fatalf("error is %T, want *ApiError", err)
+				}
+				if apiErr.Code != tc.code {
+					t.Errorf("Code = %v, want %v", apiErr.Code, tc.code)
+				}
+			}
+		})
+	}
+}
+
+func TestApiGetTokenTransportError(t *testing.T) {
+	api := NewApiWithClient(&fakeHTTPClient{err: io.ErrClosedPipe})
+	ok, msg := api.getToken(1, "paste")
+	if ok {
+		t.Fatalf("getToken() ok = true, want false on transport error")
+	}
+	if msg != io.ErrClosedPipe.Error() {
+		t.Errorf("getToken() msg = %q, want %q", msg, io.ErrClosedPipe.Error())
+	}
+}
@@ -0,0 +1,155 @@
+package drawer
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPath           = "/ws"
+	wsInitialBackoff = time.Second
+	wsMaxBackoff     = 30 * time.Second
+	// wsStableConnDuration is how long a connection has to stay up before
+	// a later drop is treated as a fresh failure instead of a continuation
+	// of the backoff sequence, so a flaky startup doesn't permanently pin
+	// WS sync to httpBoardSource.
+	wsStableConnDuration = 60 * time.Second
+)
+
+// BoardSource keeps board[] in sync with the server. Run blocks until ctx
+// is cancelled.
+type BoardSource interface {
+	Run(ctx context.Context)
+}
+
+// httpBoardSource is the legacy behaviour: re-download the whole board on
+// a fixed interval. It also serves as the fallback when WS connections
+// keep failing.
+type httpBoardSource struct {
+	api      *Api
+	interval time.Duration
+}
+
+func newHTTPBoardSource(api *Api, interval time.Duration) *httpBoardSource {
+	return &httpBoardSource{api: api, interval: interval}
+}
+
+func (s *httpBoardSource) Run(ctx context.Context) {
+	for {
+		s.api.Update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// wsBoardSource does one HTTP snapshot to seed board[], then streams binary
+// (x,y,color) deltas over a WebSocket connection, reconnecting with
+// exponential backoff. After six attempts in a row that either fail to
+// connect or drop before wsStableConnDuration, it gives up and hands off
+// to httpBoardSource.
+type wsBoardSource struct {
+	api      *Api
+	fallback *httpBoardSource
+}
+
+// NewBoardSource builds the preferred BoardSource: WebSocket deltas backed
+// by a snapshot, falling back to plain HTTP polling at interval if WS
+// connections keep failing or dropping.
+func NewBoardSource(api *Api, interval time.Duration) BoardSource {
+	return &wsBoardSource{api: api, fallback: newHTTPBoardSource(api, interval)}
+}
+
+func (s *wsBoardSource) Run(ctx context.Context) {
+	s.api.Update()
+
+	backoff := wsInitialBackoff
+	for {
+		connectedAt := time.Now()
+		err := s.readLoop(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("WS board sync dropped:", err)
+
+		if time.Since(connectedAt) >= wsStableConnDuration {
+			backoff = wsInitialBackoff
+		}
+
+		if backoff >= wsMaxBackoff {
+			log.Println("WS handshake keeps failing, falling back to HTTP polling")
+			s.fallback.Run(ctx)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > wsMaxBackoff {
+			backoff = wsMaxBackoff
+		}
+	}
+}
+
+func (s *wsBoardSource) readLoop(ctx context.Context) error {
+	wsRoot := strings.Replace(rootUrl, "http", "ws", 1)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsRoot+wsPath, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		s.applyDelta(msg)
+	}
+}
+
+// applyDelta decodes one (x,y,color) delta frame, writes it into board[]
+// under boardLock, and reports it to the registered delta hook so a
+// griefed pixel can be queued for repaint immediately.
+func (s *wsBoardSource) applyDelta(msg []byte) {
+	if len(msg) < 11 {
+		return
+	}
+
+	x := int(binary.BigEndian.Uint32(msg[0:4]))
+	y := int(binary.BigEndian.Uint32(msg[4:8]))
+	c := int(msg[8])<<16 | int(msg[9])<<8 | int(msg[10])
+
+	if x < 0 || x >= WIDTH || y < 0 || y >= HEIGHT {
+		log.Println("WS delta frame out of bounds, dropping:", x, y)
+		return
+	}
+
+	boardLock.Lock()
+	board[x*HEIGHT+y] = c
+	boardLock.Unlock()
+
+	if s.api.onDelta != nil {
+		s.api.onDelta(x, y, c)
+	}
+}
@@ -1,11 +1,18 @@
 package drawer
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
+	"math"
 	"os"
 	"sync"
 	"time"
@@ -29,14 +36,51 @@ const (
 	WAIT_BUF        = 40000
 )
 
+// Weights applied by priority() when scoring a pending pixel. Mask weight
+// dominates (it's an explicit user call-out), recency rewards pixels a
+// griefer keeps re-touching, and center bias is a small tie-breaker.
+const (
+	maskWeightScale = 10.0
+	recencyScale    = 5.0
+	centerBiasScale = 2.0
+	griefWindow     = 5 * time.Minute
+)
+
 type ImageDrawer struct {
 	api     *Api
 	ImgPath string
+	// imgHash identifies the current target's content for the StateStore
+	// uncert bitmap key, so a differently-named-but-identical image (or
+	// the same image moved) doesn't load someone else's pending offsets.
+	imgHash string
 	img     image.Image
 	X, Y    int
 	uncert  []bool
-	// pixels waiting to draw
-	waited chan int
+	// Palette restricts SetImage to the colors the server actually
+	// renders; leave empty to draw the source image as-is.
+	Palette []color.RGBA
+	// UseLab matches Palette by CIE Lab distance instead of squared
+	// Euclidean RGB distance.
+	UseLab bool
+	// Dither applies Floyd–Steinberg error diffusion when quantizing to
+	// Palette. Ignored if Palette is empty.
+	Dither bool
+	// Mask is an optional per-pixel importance weight aligned with img;
+	// brighter (by luminance) means higher scheduling priority. Leave nil
+	// to weight every pixel equally.
+	Mask image.Image
+	// SkipTransparent keeps fully-transparent source pixels out of the
+	// schedule entirely, instead of painting them as black.
+	SkipTransparent bool
+
+	// pixels waiting to draw, ordered by priority
+	waited *PixelQueue
+	// recent overwrite timestamps per offset, used for griefer detection
+	overwrites   map[int][]time.Time
+	overwritesMu sync.Mutex
+	// last time each uid successfully set a pixel, for /status
+	lastSuccess   map[int]time.Time
+	lastSuccessMu sync.Mutex
 	// unused tokens
 	unused     chan int
 	ctx        context.Context
@@ -46,8 +90,10 @@ type ImageDrawer struct {
 func NewDrawer(api *Api) *ImageDrawer {
 	draw := &ImageDrawer{}
 	draw.api = api
-	draw.waited = make(chan int, WAIT_BUF)
+	draw.waited = NewPixelQueue()
 	draw.uncert = make([]bool, UNCERT_LEN)
+	draw.overwrites = make(map[int][]time.Time)
+	draw.lastSuccess = make(map[int]time.Time)
 	draw.unused = make(chan int, UNUSED_BUF)
 	draw.ctx, draw.cancelFunc = nil, nil
 	return draw
@@ -64,18 +110,53 @@ func (draw *ImageDrawer) Reset() {
 		draw.cancelFunc = nil
 	}
 
-	draw.waited = nil
+	if draw.waited != nil {
+		draw.waited.Close()
+	}
 	draw.unused = nil
 	for i := range draw.uncert {
 		draw.uncert[i] = false
 	}
-	draw.waited = make(chan int, WAIT_BUF)
+	draw.overwritesMu.Lock()
+	draw.overwrites = make(map[int][]time.Time)
+	draw.overwritesMu.Unlock()
+	draw.waited = NewPixelQueue()
 	draw.unused = make(chan int, UNUSED_BUF)
+
+	cooldowns := draw.loadCooldowns()
+
 	draw.api.lock.RLock()
 	defer draw.api.lock.RUnlock()
 	for k := range draw.api.cache {
-		draw.unused <- k
+		uid := k
+		wait := time.Until(cooldowns[uid])
+		if wait <= 0 {
+			draw.unused <- uid
+			continue
+		}
+		log.Println("uid", uid, "still cooling down for", wait)
+		unused := draw.unused
+		go func() {
+			time.Sleep(wait)
+			unused <- uid
+		}()
+	}
+}
+
+// loadCooldowns reads persisted per-uid cooldowns from the StateStore, if
+// one is configured, so a restart doesn't immediately re-attempt a pixel
+// on every uid and trip the server's cooldown all at once.
+func (draw *ImageDrawer) loadCooldowns() map[int]time.Time {
+	if draw.api.store == nil {
+		return nil
+	}
+
+	cooldowns, err := draw.api.store.Cooldowns()
+	if err != nil {
+		log.Println("Could not load cooldowns:", err)
+		return nil
 	}
+	return cooldowns
 }
 
 // need check exists !
@@ -85,12 +166,18 @@ func (draw *ImageDrawer) SetImage(path string) error {
 		return err
 	}
 
-	defer f.Close()
+	bs, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
 
 	draw.Reset()
 	draw.ImgPath = path
+	sum := sha256.Sum256(bs)
+	draw.imgHash = hex.EncodeToString(sum[:])
 
-	draw.img, _, err = image.Decode(f)
+	draw.img, _, err = image.Decode(bytes.NewReader(bs))
 	if err != nil {
 		return err
 	}
@@ -99,9 +186,50 @@ func (draw *ImageDrawer) SetImage(path string) error {
 	if draw.img.Bounds().Dx() > 200 || draw.img.Bounds().Dy() > 200 {
 		return &DrawerError{"Too Large !!!"}
 	}
+
+	if len(draw.Palette) > 0 {
+		log.Println("Quantizing to palette of", len(draw.Palette), "colors, dither:", draw.Dither)
+		draw.img = quantizeImage(draw.img, draw.Palette, draw.UseLab, draw.Dither)
+	}
+
+	draw.restoreUncert()
 	return nil
 }
 
+// stateKey identifies the current target for StateStore's uncert bucket:
+// content hash plus placement, so moving the same image or reusing a path
+// for a different image can't cross-contaminate pending state.
+func (draw *ImageDrawer) stateKey() string {
+	return fmt.Sprintf("%s:%d:%d", draw.imgHash, draw.X, draw.Y)
+}
+
+// restoreUncert reloads the persisted pending-offset bitmap for the
+// current image+placement, if a StateStore is configured, and re-queues
+// it immediately instead of waiting for the next check() scan.
+func (draw *ImageDrawer) restoreUncert() {
+	if draw.api.store == nil {
+		return
+	}
+
+	bits, err := draw.api.store.LoadUncert(draw.stateKey())
+	if err != nil {
+		log.Println("Could not load uncert bitmap:", err)
+		return
+	}
+	if bits == nil {
+		return
+	}
+
+	bx, by := draw.img.Bounds().Dx(), draw.img.Bounds().Dy()
+	for offset, pending := range decodeBitset(bits, len(draw.uncert)) {
+		if !pending {
+			continue
+		}
+		draw.uncert[offset] = true
+		draw.waited.Push(offset, draw.priority(offset, offset/by, offset%by, bx, by))
+	}
+}
+
 func (draw *ImageDrawer) ImageSize() (int, int) {
 	return draw.img.Bounds().Dx(), draw.img.Bounds().Dy()
 }
@@ -109,7 +237,140 @@ func (draw *ImageDrawer) ImageSize() (int, int) {
 func (draw *ImageDrawer) GetPixel(x, y int) int {
 	r, g, b, _ := draw.img.At(x, y).RGBA()
 	r, g, b = r>>8, g>>8, b>>8
-	return int((r << 16) | (g << 8) | b)
+	px := int((r << 16) | (g << 8) | b)
+
+	// Without a Palette, img still holds un-quantized source colors and
+	// the server is known to render pure white as this gray (0xaaaaaa)
+	// instead; with a Palette, SetImage already quantized to a color the
+	// board can actually render, so this guess would only fight it.
+	if len(draw.Palette) == 0 && px == 0xFFFFFF {
+		return 0xaaaaaa
+	}
+	return px
+}
+
+// isTransparent reports whether the source image is fully transparent at
+// img-local (i, j).
+func (draw *ImageDrawer) isTransparent(i, j int) bool {
+	_, _, _, a := draw.img.At(i, j).RGBA()
+	return a == 0
+}
+
+// maskWeight looks up the user-supplied importance mask at img-local
+// (i, j); pixels outside the mask, or with no mask set, weight as 1.
+func (draw *ImageDrawer) maskWeight(i, j int) float64 {
+	if draw.Mask == nil {
+		return 1
+	}
+	b := draw.Mask.Bounds()
+	if i >= b.Dx() || j >= b.Dy() {
+		return 1
+	}
+
+	r, g, bch, _ := draw.Mask.At(b.Min.X+i, b.Min.Y+j).RGBA()
+	lum := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bch)) / 0xffff
+	return lum * maskWeightScale
+}
+
+// recordOverwrite notes that offset was just found to differ from target,
+// pruning hits older than griefWindow, so recencyBoost can tell a pixel a
+// griefer keeps re-touching from one that was simply never painted yet.
+func (draw *ImageDrawer) recordOverwrite(offset int) {
+	now := time.Now()
+	cutoff := now.Add(-griefWindow)
+
+	draw.overwritesMu.Lock()
+	defer draw.overwritesMu.Unlock()
+
+	hits := draw.overwrites[offset][:0]
+	for _, t := range draw.overwrites[offset] {
+		if t.After(cutoff) {
+			hits = append(hits, t)
+		}
+	}
+	draw.overwrites[offset] = append(hits, now)
+}
+
+func (draw *ImageDrawer) recencyBoost(offset int) float64 {
+	draw.overwritesMu.Lock()
+	defer draw.overwritesMu.Unlock()
+	return float64(len(draw.overwrites[offset])) * recencyScale
+}
+
+// centerBias favors pixels near the middle of the target image, on the
+// theory that a viewer's eye (and a griefer's aim) lands there first.
+func centerBias(i, j, bx, by int) float64 {
+	cx, cy := float64(bx)/2, float64(by)/2
+	maxDist := math.Hypot(cx, cy)
+	if maxDist == 0 {
+		return centerBiasScale
+	}
+
+	dist := math.Hypot(float64(i)-cx, float64(j)-cy)
+	return (1 - dist/maxDist) * centerBiasScale
+}
+
+// priority scores a pending pixel for the PixelQueue: mask weight, a
+// recency boost for pixels repeatedly griefed, and a center-distance bias.
+func (draw *ImageDrawer) priority(offset, i, j, bx, by int) float64 {
+	return draw.maskWeight(i, j) + draw.recencyBoost(offset) + centerBias(i, j, bx, by)
+}
+
+// handleDelta is the BoardSource delta hook: it runs on every pixel change
+// the server pushes over the WebSocket. If the pixel falls inside our
+// target image and no longer matches it, the offset is queued right away
+// instead of waiting for the next check() scan.
+func (draw *ImageDrawer) handleDelta(x, y, c int) {
+	if draw.img == nil {
+		return
+	}
+
+	i, j := x-draw.X, y-draw.Y
+	bx, by := draw.img.Bounds().Dx(), draw.img.Bounds().Dy()
+	if i < 0 || j < 0 || i >= bx || j >= by {
+		return
+	}
+	if draw.SkipTransparent && draw.isTransparent(i, j) {
+		return
+	}
+
+	offset := i*by + j
+	exp := draw.GetPixel(i, j)
+	if c == exp {
+		return
+	}
+
+	draw.recordOverwrite(offset)
+	if !draw.uncert[offset] {
+		draw.uncert[offset] = true
+		log.Printf("WS diff at %d, %d (to %d %d), expect %#x got %#x\n", i, j, x, y, exp, c)
+	}
+	draw.waited.Push(offset, draw.priority(offset, i, j, bx, by))
+}
+
+// Remaining returns the number of pixels currently queued to draw.
+func (draw *ImageDrawer) Remaining() int {
+	return draw.waited.Len()
+}
+
+// LastSuccess returns a snapshot of the last time each uid successfully
+// set a pixel.
+func (draw *ImageDrawer) LastSuccess() map[int]time.Time {
+	draw.lastSuccessMu.Lock()
+	defer draw.lastSuccessMu.Unlock()
+
+	copyed := make(map[int]time.Time, len(draw.lastSuccess))
+	for k, v := range draw.lastSuccess {
+		copyed[k] = v
+	}
+	return copyed
+}
+
+// Stop cancels a running Start, if any.
+func (draw *ImageDrawer) Stop() {
+	if draw.cancelFunc != nil {
+		draw.cancelFunc()
+	}
 }
 
 func (draw *ImageDrawer) WorkStatus() int {
@@ -117,12 +378,12 @@ func (draw *ImageDrawer) WorkStatus() int {
 		return -1
 	}
 
-	if rem := len(draw.waited); rem < 2 {
+	if rem := draw.waited.Len(); rem < 2 {
 		return 0
 	} else if len(draw.api.cache) == 0 {
 		return -2
 	} else {
-		return rem * INTERVAL / len(draw.api.cache)
+		return draw.waited.Len() * INTERVAL / len(draw.api.cache)
 	}
 }
 
@@ -133,6 +394,15 @@ func (draw *ImageDrawer) Start() {
 	lock, counter := new(sync.Mutex), new(int)
 	startTime := time.Now().Unix()
 
+	draw.api.SetDeltaHook(draw.handleDelta)
+	go NewBoardSource(draw.api, UPDATE_INTERVAL*time.Second).Run(draw.ctx)
+
+	waited := draw.waited
+	go func() {
+		<-draw.ctx.Done()
+		waited.Close()
+	}()
+
 	go draw.check(draw.ctx)
 	for i := 0; i < WORKER_COUNT; i++ {
 		go draw.work(lock, counter)
@@ -162,15 +432,8 @@ func (draw *ImageDrawer) Start() {
 
 func (draw *ImageDrawer) work(lock *sync.Mutex, counter *int) {
 	ImY := draw.img.Bounds().Dy()
-	var v int
-	var ok bool
 	for {
-		select {
-		case v, ok = <-draw.waited:
-		case <-draw.ctx.Done():
-			log.Println("Work Quit...")
-			return
-		}
+		v, ok := draw.waited.Pop()
 		if !ok {
 			log.Println("Work Quit...")
 			return
@@ -178,33 +441,44 @@ func (draw *ImageDrawer) work(lock *sync.Mutex, counter *int) {
 		draw.uncert[v] = false
 		uid := <-draw.unused
 		x, y := v/ImY, v%ImY
-		r, g, b, _ := draw.img.At(x, y).RGBA()
-		r, g, b = r>>8, g>>8, b>>8
-		// log.Println("Try Setting ", draw.X + x, draw.Y, r, g, b)
+		// log.Println("Try Setting ", draw.X + x, draw.Y)
 		tok, ok := draw.api.getCache(uid)
 		if !ok {
 			continue
 		}
 
-		exp := int((r << 16) | (g << 8) | b)
-		if exp == 0xFFFFFF {
-			exp = 0xaaaaaa
-		}
+		exp := draw.GetPixel(x, y)
+
+		setStart := time.Now()
+		setErr := draw.api.SetPixel(x+draw.X, y+draw.Y, exp, uid, tok)
+		if setErr == nil {
+			pixelsSetTotal.Inc()
+			pixelSetLatency.Observe(time.Since(setStart).Seconds())
+			draw.lastSuccessMu.Lock()
+			draw.lastSuccess[uid] = time.Now()
+			draw.lastSuccessMu.Unlock()
 
-		ok = draw.api.SetPixel(x+draw.X, y+draw.Y, exp, uid, tok)
-		if ok {
-			if rem := len(draw.waited); rem != 0 {
+			if rem := draw.waited.Len(); rem != 0 {
 				log.Println("Still ", rem, "pixels in queue... >=", rem*INTERVAL/len(draw.api.cache), "s")
 			}
+
+			nextAllowed := time.Now().Add(time.Duration(INTERVAL)*time.Second - time.Second/15)
+			if draw.api.store != nil {
+				if err := draw.api.store.SaveCooldown(uid, nextAllowed); err != nil {
+					log.Println("Could not persist cooldown:", err)
+				}
+			}
+
 			go func() {
 				lock.Lock()
 				*counter += 1
 				lock.Unlock()
 
-				time.Sleep(time.Duration(INTERVAL)*time.Second - time.Second/15)
+				time.Sleep(time.Until(nextAllowed))
 				draw.unused <- uid
 			}()
 		} else {
+			pixelsFailedTotal.WithLabelValues(reasonFor(setErr)).Inc()
 			draw.unused <- uid
 		}
 	}
@@ -234,26 +508,33 @@ func (draw *ImageDrawer) check(ctx context.Context) {
 		case <-timeout:
 		case <-ctx.Done():
 			log.Println("Check Quit...")
+			draw.saveUncert()
 			return
 		}
 
-		draw.api.Update()
+		// board[] is kept fresh by the BoardSource goroutine started in
+		// Start(); this loop only needs to re-scan for drift.
 		x, y := draw.img.Bounds().Dx(), draw.img.Bounds().Dy()
 
 		put := func(i, j int) {
+			if draw.SkipTransparent && draw.isTransparent(i, j) {
+				return
+			}
+
 			offset := i*y + j
-			r, g, b, _ := draw.img.At(i, j).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-			exp := int((r << 16) | (g << 8) | b)
-			if exp == 0xFFFFFF {
-				exp = 0xaaaaaa
+			exp := draw.GetPixel(i, j)
+
+			got := draw.api.GetPixel(draw.X+i, draw.Y+j)
+			if exp == got {
+				return
 			}
 
-			if exp != draw.api.GetPixel(draw.X+i, draw.Y+j) && !draw.uncert[offset] {
+			draw.recordOverwrite(offset)
+			if !draw.uncert[offset] {
 				draw.uncert[offset] = true
-				log.Printf("Diff at %d, %d (to %d %d), expect %#x got %#x\n", i, j, i+draw.X, j+draw.Y, exp, draw.api.GetPixel(draw.X+i, draw.Y+j))
-				draw.waited <- offset
+				log.Printf("Diff at %d, %d (to %d %d), expect %#x got %#x\n", i, j, i+draw.X, j+draw.Y, exp, got)
 			}
+			draw.waited.Push(offset, draw.priority(offset, i, j, x, y))
 		}
 
 		// for _, offset := range rand.Perm(x * y) {
@@ -262,7 +543,20 @@ func (draw *ImageDrawer) check(ctx context.Context) {
 			put(i, j)
 		}
 
-		log.Println("Draw Remain: ", len(draw.waited))
+		log.Println("Draw Remain: ", draw.waited.Len())
+		draw.saveUncert()
 		time.Sleep(waitTime * time.Second)
 	}
 }
+
+// saveUncert persists the current pending-offset bitmap, if a StateStore
+// is configured, so a crash doesn't lose track of what's already known to
+// be wrong and force a full board rescan to rediscover it.
+func (draw *ImageDrawer) saveUncert() {
+	if draw.api.store == nil {
+		return
+	}
+	if err := draw.api.store.SaveUncert(draw.stateKey(), encodeBitset(draw.uncert)); err != nil {
+		log.Println("Could not persist uncert bitmap:", err)
+	}
+}
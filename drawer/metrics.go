@@ -0,0 +1,48 @@
+package drawer
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	pixelsSetTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pixels_set_total",
+		Help: "Successful SetPixel calls.",
+	})
+	pixelsFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixels_failed_total",
+		Help: "Failed SetPixel calls, labeled by failure reason.",
+	}, []string{"reason"})
+	tokensActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tokens_active",
+		Help: "Number of uids currently holding a cached token.",
+	})
+	pixelSetLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixel_set_latency_seconds",
+		Help:    "Latency of successful SetPixel calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pixelsSetTotal, pixelsFailedTotal, tokensActive, pixelSetLatency)
+}
+
+// reasonFor turns a SetPixel error into a metrics label.
+func reasonFor(err error) string {
+	apiErr, ok := err.(*ApiError)
+	if !ok {
+		return "network"
+	}
+
+	switch apiErr.Code {
+	case ErrInvalidToken:
+		return "invalid_token"
+	case ErrCooldown:
+		return "cooldown"
+	case ErrOutOfRange:
+		return "out_of_range"
+	case ErrBanned:
+		return "banned"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,136 @@
+package drawer
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// rgbDistance is squared Euclidean distance in sRGB space.
+func rgbDistance(a, b color.RGBA) float64 {
+	dr := float64(a.R) - float64(b.R)
+	dg := float64(a.G) - float64(b.G)
+	db := float64(a.B) - float64(b.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// labDistance is squared Euclidean distance in CIE L*a*b*, which tracks
+// perceived color difference better than raw RGB at the cost of a couple
+// of extra conversions per comparison.
+func labDistance(a, b color.RGBA) float64 {
+	la, lb := rgbToLab(a), rgbToLab(b)
+	dl, da, db := la[0]-lb[0], la[1]-lb[1], la[2]-lb[2]
+	return dl*dl + da*da + db*db
+}
+
+func rgbToLab(c color.RGBA) [3]float64 {
+	linearize := func(v float64) float64 {
+		v /= 255
+		if v > 0.04045 {
+			return math.Pow((v+0.055)/1.055, 2.4)
+		}
+		return v / 12.92
+	}
+	r, g, b := linearize(float64(c.R)), linearize(float64(c.G)), linearize(float64(c.B))
+
+	x := (r*0.4124 + g*0.3576 + b*0.1805) / 0.95047
+	y := r*0.2126 + g*0.7152 + b*0.0722
+	z := (r*0.0193 + g*0.1192 + b*0.9505) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 0.008856 {
+			return math.Cbrt(t)
+		}
+		return 7.787*t + 16.0/116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// nearestPaletteColor returns the entry of palette closest to c.
+func nearestPaletteColor(palette []color.RGBA, c color.RGBA, useLab bool) color.RGBA {
+	dist := rgbDistance
+	if useLab {
+		dist = labDistance
+	}
+
+	best, bestDist := palette[0], math.MaxFloat64
+	for _, p := range palette {
+		if d := dist(c, p); d < bestDist {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+func clamp8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// quantizeImage snaps every pixel of src to the nearest color in palette,
+// optionally spreading the quantization error to neighbouring pixels with
+// Floyd–Steinberg dithering, and returns the result as a standalone image
+// so later reads (GetPixel, the check() diff) never see the original
+// colors again.
+func quantizeImage(src image.Image, palette []color.RGBA, useLab, dither bool) *image.RGBA {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	type rgbErr struct{ r, g, b float64 }
+	var errs [][]rgbErr
+	if dither {
+		errs = make([][]rgbErr, h)
+		for i := range errs {
+			errs[i] = make([]rgbErr, w)
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, a := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			orig := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+
+			if dither {
+				e := errs[y][x]
+				orig.R = clamp8(float64(orig.R) + e.r)
+				orig.G = clamp8(float64(orig.G) + e.g)
+				orig.B = clamp8(float64(orig.B) + e.b)
+			}
+
+			quant := nearestPaletteColor(palette, orig, useLab)
+			out.SetRGBA(x, y, color.RGBA{R: quant.R, G: quant.G, B: quant.B, A: orig.A})
+
+			if !dither {
+				continue
+			}
+
+			er := float64(orig.R) - float64(quant.R)
+			eg := float64(orig.G) - float64(quant.G)
+			eb := float64(orig.B) - float64(quant.B)
+
+			spread := func(dx, dy int, frac float64) {
+				nx, ny := x+dx, y+dy
+				if nx < 0 || nx >= w || ny < 0 || ny >= h {
+					return
+				}
+				errs[ny][nx].r += er * frac
+				errs[ny][nx].g += eg * frac
+				errs[ny][nx].b += eb * frac
+			}
+			spread(1, 0, 7.0/16)
+			spread(-1, 1, 3.0/16)
+			spread(0, 1, 5.0/16)
+			spread(1, 1, 1.0/16)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,95 @@
+package drawer
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestNearestPaletteColorRGB(t *testing.T) {
+	palette := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255},
+		{R: 255, G: 255, B: 255, A: 255},
+		{R: 255, G: 0, B: 0, A: 255},
+	}
+
+	got := nearestPaletteColor(palette, color.RGBA{R: 200, G: 10, B: 10, A: 255}, false)
+	want := color.RGBA{R: 255, G: 0, B: 0, A: 255}
+	if got != want {
+		t.Errorf("nearestPaletteColor() = %+v, want %+v", got, want)
+	}
+
+	got = nearestPaletteColor(palette, color.RGBA{R: 10, G: 10, B: 10, A: 255}, false)
+	want = color.RGBA{R: 0, G: 0, B: 0, A: 255}
+	if got != want {
+		t.Errorf("nearestPaletteColor() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNearestPaletteColorLab(t *testing.T) {
+	palette := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255},
+		{R: 255, G: 255, B: 0, A: 255},
+	}
+
+	got := nearestPaletteColor(palette, color.RGBA{R: 230, G: 230, B: 20, A: 255}, true)
+	want := color.RGBA{R: 255, G: 255, B: 0, A: 255}
+	if got != want {
+		t.Errorf("nearestPaletteColor(useLab) = %+v, want %+v", got, want)
+	}
+}
+
+func TestQuantizeImageNoDither(t *testing.T) {
+	palette := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255},
+		{R: 255, G: 255, B: 255, A: 255},
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, color.RGBA{R: 10, G: 10, B: 10, A: 255})
+	src.SetRGBA(1, 0, color.RGBA{R: 240, G: 240, B: 240, A: 255})
+
+	out := quantizeImage(src, palette, false, false)
+
+	if got := out.RGBAAt(0, 0); got.R != 0 || got.G != 0 || got.B != 0 {
+		t.Errorf("pixel (0,0) = %+v, want black", got)
+	}
+	if got := out.RGBAAt(1, 0); got.R != 255 || got.G != 255 || got.B != 255 {
+		t.Errorf("pixel (1,0) = %+v, want white", got)
+	}
+}
+
+func TestQuantizeImageDitherSpreadsError(t *testing.T) {
+	// A uniform 50% gray with only black/white in the palette: every
+	// pixel quantizes to black or white, and dithering should produce a
+	// mix of both rather than snapping every pixel to the same color.
+	palette := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255},
+		{R: 255, G: 255, B: 255, A: 255},
+	}
+
+	const w, h = 8, 8
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+		}
+	}
+
+	out := quantizeImage(src, palette, false, true)
+
+	blacks, whites := 0, 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if out.RGBAAt(x, y).R == 0 {
+				blacks++
+			} else {
+				whites++
+			}
+		}
+	}
+
+	if blacks == 0 || whites == 0 {
+		t.Errorf("dithering did not spread error: blacks=%d whites=%d", blacks, whites)
+	}
+}
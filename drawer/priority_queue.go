@@ -0,0 +1,111 @@
+package drawer
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// pixelJob is one scheduled repaint, ordered by priority (higher runs
+// first). offset is the img-local i*by+j index used throughout the
+// drawer package.
+type pixelJob struct {
+	offset   int
+	priority float64
+	index    int
+}
+
+type jobHeap []*pixelJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].priority > h[j].priority }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	job := x.(*pixelJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*h = old[:n-1]
+	return job
+}
+
+// PixelQueue is a priority queue of pending repaints. It replaces the
+// plain `chan int` FIFO so a handful of high-priority pixels (logos,
+// griefed regions) get repainted ahead of background fill, and so a
+// pixel that's re-scored while still pending (e.g. a fresh griefer hit)
+// updates in place instead of queuing a duplicate entry.
+type PixelQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	heap   jobHeap
+	byOff  map[int]*pixelJob
+	closed bool
+}
+
+func NewPixelQueue() *PixelQueue {
+	q := &PixelQueue{byOff: make(map[int]*pixelJob)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push schedules offset at priority, or re-scores it in place if it's
+// already queued.
+func (q *PixelQueue) Push(offset int, priority float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+
+	if job, ok := q.byOff[offset]; ok {
+		job.priority = priority
+		heap.Fix(&q.heap, job.index)
+		return
+	}
+
+	job := &pixelJob{offset: offset, priority: priority}
+	heap.Push(&q.heap, job)
+	q.byOff[offset] = job
+	q.cond.Signal()
+}
+
+// Pop blocks until the highest-priority pending offset is available, or
+// the queue has been closed and drained, in which case ok is false.
+func (q *PixelQueue) Pop() (offset int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.heap) == 0 {
+		if q.closed {
+			return 0, false
+		}
+		q.cond.Wait()
+	}
+
+	job := heap.Pop(&q.heap).(*pixelJob)
+	delete(q.byOff, job.offset)
+	return job.offset, true
+}
+
+func (q *PixelQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap)
+}
+
+// Close wakes every blocked Pop, which then returns ok=false once drained.
+func (q *PixelQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,55 @@
+package drawer
+
+import "testing"
+
+func TestPixelQueuePopsHighestPriorityFirst(t *testing.T) {
+	q := NewPixelQueue()
+	q.Push(1, 1.0)
+	q.Push(2, 5.0)
+	q.Push(3, 3.0)
+
+	want := []int{2, 3, 1}
+	for _, w := range want {
+		off, ok := q.Pop()
+		if !ok {
+			t.Fatalf("Pop() ok = false, want true")
+		}
+		if off != w {
+			t.Errorf("Pop() = %d, want %d", off, w)
+		}
+	}
+}
+
+func TestPixelQueueReprioritizesInPlace(t *testing.T) {
+	q := NewPixelQueue()
+	q.Push(1, 1.0)
+	q.Push(2, 2.0)
+
+	// Re-score offset 1 above offset 2 instead of queuing a duplicate.
+	q.Push(1, 10.0)
+
+	if got := q.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2 (re-score must not add a duplicate entry)", got)
+	}
+
+	off, ok := q.Pop()
+	if !ok || off != 1 {
+		t.Fatalf("Pop() = (%d, %v), want (1, true)", off, ok)
+	}
+}
+
+func TestPixelQueueCloseUnblocksPop(t *testing.T) {
+	q := NewPixelQueue()
+
+	done := make(chan struct{})
+	go func() {
+		_, ok := q.Pop()
+		if ok {
+			t.Error("Pop() ok = true after Close(), want false")
+		}
+		close(done)
+	}()
+
+	q.Close()
+	<-done
+}
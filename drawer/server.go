@@ -0,0 +1,194 @@
+package drawer
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server exposes an ImageDrawer over HTTP so the bot can run headless
+// (systemd, docker) and be monitored or controlled remotely. The stdin
+// REPL in main is just a thin client over the same ImageDrawer/Api calls.
+type Server struct {
+	draw *ImageDrawer
+	addr string
+}
+
+func NewServer(draw *ImageDrawer, addr string) *Server {
+	return &Server{draw: draw, addr: addr}
+}
+
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/board.png", s.handleBoardPNG)
+	mux.HandleFunc("/target.png", s.handleTargetPNG)
+	mux.HandleFunc("/image", s.handleImage)
+	mux.HandleFunc("/tokens", s.handleTokens)
+	mux.HandleFunc("/start", s.handleStart)
+	mux.HandleFunc("/stop", s.handleStop)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(s.addr, mux)
+}
+
+type statusResponse struct {
+	Tokens      int           `json:"tokens"`
+	WorkStatus  int           `json:"work_status"`
+	Remaining   int           `json:"remaining"`
+	ImgPath     string        `json:"img_path"`
+	X           int           `json:"x"`
+	Y           int           `json:"y"`
+	LastSuccess map[int]int64 `json:"last_success"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	lastSuccess := make(map[int]int64)
+	for uid, t := range s.draw.LastSuccess() {
+		lastSuccess[uid] = t.Unix()
+	}
+
+	resp := statusResponse{
+		Tokens:      len(s.draw.GetTokens()),
+		WorkStatus:  s.draw.WorkStatus(),
+		Remaining:   s.draw.Remaining(),
+		ImgPath:     s.draw.ImgPath,
+		X:           s.draw.X,
+		Y:           s.draw.Y,
+		LastSuccess: lastSuccess,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleBoardPNG(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	if err := s.draw.api.SaveBoard(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleTargetPNG(w http.ResponseWriter, r *http.Request) {
+	if s.draw.img == nil {
+		http.Error(w, "no image set", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, s.draw.img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp("", "paint-upload-*.png")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	x, y := s.draw.X, s.draw.Y
+	if v := r.FormValue("x"); v != "" {
+		nx, err := strconv.Atoi(v)
+		if err != nil || nx < 0 || nx > WIDTH {
+			http.Error(w, "Invalid x", http.StatusBadRequest)
+			return
+		}
+		x = nx
+	}
+	if v := r.FormValue("y"); v != "" {
+		ny, err := strconv.Atoi(v)
+		if err != nil || ny < 0 || ny > HEIGHT {
+			http.Error(w, "Invalid y", http.StatusBadRequest)
+			return
+		}
+		y = ny
+	}
+
+	// x/y must land before SetImage, since it calls restoreUncert(), which
+	// keys the saved pending-offset bitmap off stateKey()'s X/Y.
+	s.draw.X, s.draw.Y = x, y
+
+	if err := s.draw.SetImage(tmp.Name()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+type tokenRequest struct {
+	UID   int    `json:"uid"`
+	Paste string `json:"paste"`
+}
+
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqs []tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make(map[int]bool, len(reqs))
+	for _, req := range reqs {
+		ok, tok := s.draw.api.GetToken(req.UID, req.Paste)
+		results[req.UID] = ok
+		if ok {
+			s.draw.AddToken(req.UID, tok)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.draw.Start()
+	fmt.Fprintln(w, "OK")
+}
+
+func (s *Server) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.draw.Stop()
+	fmt.Fprintln(w, "OK")
+}
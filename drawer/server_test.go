@@ -0,0 +1,106 @@
+package drawer
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func uploadImageRequest(t *testing.T, png []byte, x, y string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	part, err := mw.CreateFormFile("image", "target.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile() error: %v", err)
+	}
+	if _, err := part.Write(png); err != nil {
+		t.Fatalf("write image part: %v", err)
+	}
+	if x != "" {
+		mw.WriteField("x", x)
+	}
+	if y != "" {
+		mw.WriteField("y", y)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("mw.Close() error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/image", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestHandleImageAppliesPlacement(t *testing.T) {
+	draw := NewDrawer(NewApi())
+	srv := NewServer(draw, "")
+
+	rec := httptest.NewRecorder()
+	srv.handleImage(rec, uploadImageRequest(t, testPNG(t, 4, 4), "10", "20"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+	if draw.X != 10 || draw.Y != 20 {
+		t.Errorf("draw.X,Y = %d,%d, want 10,20", draw.X, draw.Y)
+	}
+}
+
+func TestHandleImageRejectsOutOfBoundsCoordinates(t *testing.T) {
+	cases := []struct{ x, y string }{
+		{"-1", "0"},
+		{"0", "-1"},
+		{"100000", "0"},
+		{"0", "100000"},
+	}
+
+	for _, tc := range cases {
+		draw := NewDrawer(NewApi())
+		srv := NewServer(draw, "")
+
+		rec := httptest.NewRecorder()
+		srv.handleImage(rec, uploadImageRequest(t, testPNG(t, 4, 4), tc.x, tc.y))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("x=%s y=%s: status = %d, want 400", tc.x, tc.y, rec.Code)
+		}
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	draw := NewDrawer(NewApi())
+	draw.X, draw.Y = 5, 6
+	srv := NewServer(draw, "")
+
+	rec := httptest.NewRecorder()
+	srv.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+
+	var resp statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if resp.X != 5 || resp.Y != 6 {
+		t.Errorf("resp.X,Y = %d,%d, want 5,6", resp.X, resp.Y)
+	}
+}
@@ -0,0 +1,174 @@
+package drawer
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketTokens    = []byte("tokens")
+	bucketCooldowns = []byte("cooldowns")
+	bucketUncert    = []byte("uncert")
+)
+
+// tokenRecord is what StateStore.Tokens returns per uid.
+type tokenRecord struct {
+	Token      string    `json:"token"`
+	ObtainedAt time.Time `json:"obtained_at"`
+}
+
+// StateStore persists tokens, per-uid cooldowns, and the pending-repaint
+// bitmap across restarts. Without one, a crash re-queues every pixel and
+// immediately trips the server's 30s cooldown on every uid at once.
+type StateStore interface {
+	SaveToken(uid int, tok string, obtainedAt time.Time) error
+	Tokens() (map[int]tokenRecord, error)
+
+	SaveCooldown(uid int, nextAllowed time.Time) error
+	Cooldowns() (map[int]time.Time, error)
+
+	// SaveUncert/LoadUncert store a compact bitset of pending offsets,
+	// keyed by image hash + X + Y so state from a different target never
+	// gets mistakenly reused.
+	SaveUncert(key string, bits []byte) error
+	LoadUncert(key string) ([]byte, error)
+
+	Close() error
+}
+
+// boltStateStore is the default StateStore, backed by a single bbolt file.
+// bbolt commits each Update in one fsynced transaction, so unlike the old
+// _api.txt writer there's no window where a crash can leave a corrupt or
+// stale-tailed file.
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStateStore opens (creating if needed) a bbolt file at path and
+// ensures its buckets exist.
+func NewBoltStateStore(path string) (StateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketTokens, bucketCooldowns, bucketUncert} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStateStore{db: db}, nil
+}
+
+func uidKey(uid int) []byte {
+	return []byte(strconv.Itoa(uid))
+}
+
+func (s *boltStateStore) SaveToken(uid int, tok string, obtainedAt time.Time) error {
+	bs, err := json.Marshal(tokenRecord{Token: tok, ObtainedAt: obtainedAt})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).Put(uidKey(uid), bs)
+	})
+}
+
+func (s *boltStateStore) Tokens() (map[int]tokenRecord, error) {
+	out := make(map[int]tokenRecord)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			uid, err := strconv.Atoi(string(k))
+			if err != nil {
+				return nil
+			}
+			var rec tokenRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return nil
+			}
+			out[uid] = rec
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltStateStore) SaveCooldown(uid int, nextAllowed time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCooldowns).Put(uidKey(uid), []byte(strconv.FormatInt(nextAllowed.Unix(), 10)))
+	})
+}
+
+func (s *boltStateStore) Cooldowns() (map[int]time.Time, error) {
+	out := make(map[int]time.Time)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCooldowns).ForEach(func(k, v []byte) error {
+			uid, err := strconv.Atoi(string(k))
+			if err != nil {
+				return nil
+			}
+			unix, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return nil
+			}
+			out[uid] = time.Unix(unix, 0)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltStateStore) SaveUncert(key string, bits []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUncert).Put([]byte(key), bits)
+	})
+}
+
+func (s *boltStateStore) LoadUncert(key string) ([]byte, error) {
+	var out []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketUncert).Get([]byte(key)); v != nil {
+			out = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *boltStateStore) Close() error {
+	return s.db.Close()
+}
+
+// encodeBitset packs bits into one byte per 8 offsets, for compact
+// storage of the (up to UNCERT_LEN-sized) uncert slice.
+func encodeBitset(bits []bool) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			out[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return out
+}
+
+func decodeBitset(bs []byte, n int) []bool {
+	out := make([]bool, n)
+	for i := range out {
+		if i/8 < len(bs) && bs[i/8]&(1<<uint(i%8)) != 0 {
+			out[i] = true
+		}
+	}
+	return out
+}
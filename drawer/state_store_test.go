@@ -0,0 +1,81 @@
+package drawer
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *boltStateStore {
+	t.Helper()
+	store, err := NewBoltStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStateStore() error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store.(*boltStateStore)
+}
+
+func TestBoltStateStoreTokenRoundtrip(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().Truncate(time.Second)
+
+	if err := store.SaveToken(1, "tok-1", now); err != nil {
+		t.Fatalf("SaveToken() error: %v", err)
+	}
+
+	tokens, err := store.Tokens()
+	if err != nil {
+		t.Fatalf("Tokens() error: %v", err)
+	}
+	rec, ok := tokens[1]
+	if !ok {
+		t.Fatalf("Tokens() missing uid 1: %v", tokens)
+	}
+	if rec.Token != "tok-1" || !rec.ObtainedAt.Equal(now) {
+		t.Errorf("Tokens()[1] = %+v, want {tok-1 %v}", rec, now)
+	}
+}
+
+func TestBoltStateStoreCooldownRoundtrip(t *testing.T) {
+	store := newTestStore(t)
+	next := time.Now().Add(30 * time.Second).Truncate(time.Second)
+
+	if err := store.SaveCooldown(2, next); err != nil {
+		t.Fatalf("SaveCooldown() error: %v", err)
+	}
+
+	cooldowns, err := store.Cooldowns()
+	if err != nil {
+		t.Fatalf("Cooldowns() error: %v", err)
+	}
+	got, ok := cooldowns[2]
+	if !ok {
+		t.Fatalf("Cooldowns() missing uid 2: %v", cooldowns)
+	}
+	if !got.Equal(next) {
+		t.Errorf("Cooldowns()[2] = %v, want %v", got, next)
+	}
+}
+
+func TestBoltStateStoreUncertRoundtrip(t *testing.T) {
+	store := newTestStore(t)
+	key := "deadbeef:10:20"
+	bits := encodeBitset([]bool{true, false, true, true, false})
+
+	if err := store.SaveUncert(key, bits); err != nil {
+		t.Fatalf("SaveUncert() error: %v", err)
+	}
+
+	got, err := store.LoadUncert(key)
+	if err != nil {
+		t.Fatalf("LoadUncert() error: %v", err)
+	}
+	if string(got) != string(bits) {
+		t.Errorf("LoadUncert() = %v, want %v", got, bits)
+	}
+
+	if got, err := store.LoadUncert("no-such-key"); err != nil || got != nil {
+		t.Errorf("LoadUncert(missing) = (%v, %v), want (nil, nil)", got, err)
+	}
+}
@@ -2,19 +2,48 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	draw "jeefy/drawer"
 	"os"
+	"path/filepath"
 	"time"
 )
 
 var api *draw.Api
 var drawer *draw.ImageDrawer
 
+var listenAddr string
+var stateDir string
+
 func init() {
 	api = draw.NewApi()
 	drawer = draw.NewDrawer(api)
+	flag.StringVar(&listenAddr, "listen", "", "address for the HTTP control/observability API (disabled if empty)")
+	flag.StringVar(&stateDir, "state-dir", "", "directory for the crash-safe state store (tokens/cooldowns/uncert); uses legacy _api.txt if empty")
+}
+
+// setupStore opens the bbolt state store under stateDir, if one was
+// requested, so multiple bot instances running side by side each get their
+// own file instead of colliding on _api.txt.
+func setupStore() {
+	if stateDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		fmt.Println("Could not create state dir:", err)
+		return
+	}
+
+	store, err := draw.NewBoltStateStore(filepath.Join(stateDir, "state.db"))
+	if err != nil {
+		fmt.Println("Could not open state store:", err)
+		return
+	}
+
+	api.SetStore(store)
 }
 
 func AddToken() {
@@ -123,6 +152,10 @@ func StartDraw() {
 	drawer.Start()
 }
 
+func StopDraw() {
+	drawer.Stop()
+}
+
 func readConfig() {
 	f, err := os.Open("config.txt")
 	if err != nil {
@@ -168,12 +201,24 @@ func readConfig() {
 }
 
 func main() {
+	flag.Parse()
 	reader := bufio.NewReader(os.Stdin)
 
+	setupStore()
 	api.ReadToken()
 	readConfig()
 
-	if len(os.Args) > 1 && os.Args[1] == "start" {
+	if listenAddr != "" {
+		server := draw.NewServer(drawer, listenAddr)
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				fmt.Println("Server error:", err)
+			}
+		}()
+		fmt.Println("Control API listening on", listenAddr)
+	}
+
+	if len(flag.Args()) > 0 && flag.Args()[0] == "start" {
 		time.Sleep(3 * time.Second)
 		StartDraw()
 	}
@@ -197,6 +242,8 @@ func main() {
 			SetY()
 		} else if opt[0] == 's' {
 			StartDraw()
+		} else if opt[0] == 'e' {
+			StopDraw()
 		} else if opt[0] == 'p' {
 			PrintPixel()
 		} else if opt[0] == 'u' {
@@ -208,6 +255,7 @@ func main() {
 			fmt.Println("输入 i / image 设置图片")
 			fmt.Println("输入 x / y 设置图片位置")
 			fmt.Println("输入 s / start 开始绘制")
+			fmt.Println("输入 e / end 停止绘制")
 			fmt.Println()
 			fmt.Println("当前信息：")
 			fmt.Println("图片：", drawer.ImgPath)